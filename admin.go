@@ -0,0 +1,196 @@
+// Copyright 2018 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// adminTokenEnv is the environment variable holding the bearer token
+// required to call the admin API.
+const adminTokenEnv = "SS_ADMIN_TOKEN"
+
+// adminMu serializes admin API changes to the config file, so that two
+// concurrent requests can't race each other's read-modify-write of the
+// YAML.
+var adminMu sync.Mutex
+
+// startAdminServer starts an HTTP server on addr exposing:
+//
+//	GET    /keys      list the configured access keys
+//	POST   /keys      add or update a single access key
+//	DELETE /keys/{id} remove a single access key
+//	POST   /reload    re-read the YAML from disk
+//
+// Every change is written to the YAML config file and applied via
+// SSServer.loadConfig, the same path SIGHUP uses, so startPort/removePort
+// and SetNumAccessKeys stay consistent regardless of how a change was
+// triggered.
+func startAdminServer(addr string, server *SSServer) error {
+	token := os.Getenv(adminTokenEnv)
+	if token == "" {
+		return fmt.Errorf("%v must be set to enable -admin-addr", adminTokenEnv)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, token) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			handleListKeys(w, server)
+		case http.MethodPost:
+			handleUpsertKey(w, r, server)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/keys/", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, token) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodDelete {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id := strings.TrimPrefix(r.URL.Path, "/keys/")
+		handleRemoveKey(w, id, server)
+	})
+	mux.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, token) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := server.loadConfig(server.configFilename); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	})
+	go func() {
+		log.Fatal(http.ListenAndServe(addr, mux))
+	}()
+	log.Printf("INFO Admin API on http://%v", addr)
+	return nil
+}
+
+func handleListKeys(w http.ResponseWriter, server *SSServer) {
+	config, err := readConfig(server.configFilename)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(config.Keys)
+}
+
+func handleUpsertKey(w http.ResponseWriter, r *http.Request, server *SSServer) {
+	var keyConfig KeyConfig
+	if err := json.NewDecoder(r.Body).Decode(&keyConfig); err != nil {
+		http.Error(w, fmt.Sprintf("invalid key: %v", err), http.StatusBadRequest)
+		return
+	}
+	if keyConfig.ID == "" {
+		http.Error(w, "id is required", http.StatusBadRequest)
+		return
+	}
+	adminMu.Lock()
+	defer adminMu.Unlock()
+	config, err := readConfig(server.configFilename)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	replaced := false
+	for i, existing := range config.Keys {
+		if existing.ID == keyConfig.ID {
+			config.Keys[i] = keyConfig
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		config.Keys = append(config.Keys, keyConfig)
+	}
+	if err := applyConfig(server, config); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func handleRemoveKey(w http.ResponseWriter, id string, server *SSServer) {
+	adminMu.Lock()
+	defer adminMu.Unlock()
+	config, err := readConfig(server.configFilename)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	kept := config.Keys[:0]
+	found := false
+	for _, existing := range config.Keys {
+		if existing.ID == id {
+			found = true
+			continue
+		}
+		kept = append(kept, existing)
+	}
+	if !found {
+		http.Error(w, "key not found", http.StatusNotFound)
+		return
+	}
+	config.Keys = kept
+	if err := applyConfig(server, config); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// applyConfig validates config, then writes it to the server's config file
+// and reloads it through SSServer.loadConfig, the same path used by SIGHUP.
+// Validating first means a bad admin request (e.g. an unsupported cipher)
+// is rejected without ever touching disk, so it can't brick the config file
+// for the next process restart.
+func applyConfig(server *SSServer, config *Config) error {
+	portKeys, err := buildPortKeys(config)
+	if err != nil {
+		return fmt.Errorf("invalid config: %v", err)
+	}
+	for _, portConfig := range config.Ports {
+		if _, ok := portKeys[portConfig.Port]; !ok {
+			return fmt.Errorf("invalid config: port %v has a transport but no access keys", portConfig.Port)
+		}
+		if _, err := newTransport(portConfig); err != nil {
+			return fmt.Errorf("invalid config: transport for port %v: %v", portConfig.Port, err)
+		}
+	}
+	if err := writeConfig(server.configFilename, config); err != nil {
+		return fmt.Errorf("failed to write config: %v", err)
+	}
+	return server.loadConfig(server.configFilename)
+}
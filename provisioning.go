@@ -0,0 +1,116 @@
+// Copyright 2018 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// sip008Key is a single entry in the SIP008 "/access-keys" response, as
+// documented at https://shadowsocks.org/guide/sip008.html.
+type sip008Key struct {
+	ID         string `json:"id"`
+	Name       string `json:"name,omitempty"`
+	Password   string `json:"password"`
+	Method     string `json:"method"`
+	Server     string `json:"server"`
+	ServerPort int    `json:"server_port"`
+	// Plugin and PluginOpts describe a SIP003 plugin (e.g. v2ray-plugin,
+	// obfs-local) the client must launch alongside Shadowsocks. Omitted for
+	// keys that don't use one.
+	Plugin     string `json:"plugin,omitempty"`
+	PluginOpts string `json:"plugin_opts,omitempty"`
+}
+
+type sip008Response struct {
+	AccessKeys []sip008Key `json:"access_keys"`
+}
+
+// provisioningTokenEnv is the environment variable holding the bearer token
+// required to query the provisioning endpoint.
+const provisioningTokenEnv = "SS_PROVISIONING_TOKEN"
+
+// startProvisioningServer starts an HTTP server on addr that serves the
+// current access keys of server in SIP008 format at GET /access-keys, so
+// Outline-compatible clients can pull their configuration directly from the
+// server instead of requiring it to be distributed out of band. Requests
+// must carry `Authorization: Bearer <token>`, where token comes from the
+// SS_PROVISIONING_TOKEN environment variable.
+func startProvisioningServer(addr, hostname string, server *SSServer) error {
+	token := os.Getenv(provisioningTokenEnv)
+	if token == "" {
+		return fmt.Errorf("%v must be set to enable -provisioning-addr", provisioningTokenEnv)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/access-keys", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, token) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(server.sip008Response(hostname)); err != nil {
+			log.Printf("ERROR Failed to write provisioning response: %v", err)
+		}
+	})
+	go func() {
+		log.Fatal(http.ListenAndServe(addr, mux))
+	}()
+	log.Printf("INFO Provisioning endpoint on http://%v/access-keys", addr)
+	return nil
+}
+
+// authorized reports whether r carries the expected bearer token. It uses
+// a constant-time comparison so that an attacker timing failed requests
+// can't learn the token a byte at a time.
+func authorized(r *http.Request, token string) bool {
+	const prefix = "Bearer "
+	got := r.Header.Get("Authorization")
+	if !strings.HasPrefix(got, prefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(got, prefix)), []byte(token)) == 1
+}
+
+// sip008Response builds the current access key list, across all ports, in
+// SIP008 format.
+func (s *SSServer) sip008Response(hostname string) sip008Response {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	resp := sip008Response{}
+	for portNum, port := range s.ports {
+		for id, key := range port.keys {
+			if key.Expired() {
+				continue
+			}
+			resp.AccessKeys = append(resp.AccessKeys, sip008Key{
+				ID:         id,
+				Name:       key.Label,
+				Password:   key.Secret,
+				Method:     key.CipherName,
+				Server:     hostname,
+				ServerPort: portNum,
+				Plugin:     key.Plugin,
+				PluginOpts: key.PluginOpts,
+			})
+		}
+	}
+	return resp
+}
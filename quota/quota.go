@@ -0,0 +1,123 @@
+// Copyright 2018 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package quota tracks per-access-key monthly data usage, so SSPort.run can
+// reject new connections for a key that has exceeded its configured quota.
+package quota
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ExceededTotal counts connections rejected for exceeding their key's quota.
+var ExceededTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "shadowsocks",
+	Subsystem: "quota",
+	Name:      "exceeded_total",
+	Help:      "Total number of connections rejected for exceeding their access key's quota",
+})
+
+func init() {
+	prometheus.MustRegister(ExceededTotal)
+}
+
+// Store tracks cumulative byte usage per access key ID across a billing
+// period. Implementations must survive config reloads: the server creates
+// one Store for the lifetime of the process and keeps using it across
+// SIGHUP/admin-API reloads, so usage counters carry over even though the
+// access keys themselves get rebuilt from YAML on every reload.
+type Store interface {
+	// AddUsage adds delta bytes to keyID's usage for the current billing
+	// period and returns the new cumulative usage.
+	AddUsage(keyID string, delta int64) int64
+	// Usage returns keyID's cumulative usage for the current billing period.
+	Usage(keyID string) int64
+}
+
+// MemStore is the default in-memory Store. All keys' counters reset
+// together once per month, on rolloverDay.
+type MemStore struct {
+	mu          sync.Mutex
+	rolloverDay int
+	usage       map[string]int64
+	periodStart time.Time
+}
+
+// NewMemStore creates a MemStore whose billing period restarts on
+// rolloverDay of each month (clamped to how many days the month has).
+func NewMemStore(rolloverDay int) *MemStore {
+	return &MemStore{
+		rolloverDay: rolloverDay,
+		usage:       make(map[string]int64),
+		periodStart: periodStart(rolloverDay, time.Now()),
+	}
+}
+
+// periodStart returns the start of the billing period that now falls in,
+// given a rollover day of the month. rolloverDay is clamped to the number
+// of days the period's month actually has, so e.g. rolloverDay 31 rolls
+// over on the last day of a 30-day month instead of overflowing into the
+// next one.
+func periodStart(rolloverDay int, now time.Time) time.Time {
+	year, month, day := now.Date()
+	if day < clampDay(rolloverDay, year, month) {
+		month--
+		if month < time.January {
+			month = time.December
+			year--
+		}
+	}
+	return time.Date(year, month, clampDay(rolloverDay, year, month), 0, 0, 0, 0, now.Location())
+}
+
+// clampDay returns day, or the last day of the given month if day is past it.
+func clampDay(day, year int, month time.Month) int {
+	if lastDay := daysInMonth(year, month); day > lastDay {
+		return lastDay
+	}
+	return day
+}
+
+// daysInMonth returns the number of days in the given month of year.
+func daysInMonth(year int, month time.Month) int {
+	return time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
+
+func (s *MemStore) rolloverIfNeeded() {
+	start := periodStart(s.rolloverDay, time.Now())
+	if start.After(s.periodStart) {
+		s.usage = make(map[string]int64)
+		s.periodStart = start
+	}
+}
+
+// AddUsage implements Store.
+func (s *MemStore) AddUsage(keyID string, delta int64) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rolloverIfNeeded()
+	s.usage[keyID] += delta
+	return s.usage[keyID]
+}
+
+// Usage implements Store.
+func (s *MemStore) Usage(keyID string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rolloverIfNeeded()
+	return s.usage[keyID]
+}
@@ -0,0 +1,80 @@
+// Copyright 2018 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quota
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPeriodStartBeforeAndAfterRolloverDay(t *testing.T) {
+	now := time.Date(2026, time.March, 10, 12, 0, 0, 0, time.UTC)
+	if got := periodStart(15, now); !got.Equal(time.Date(2026, time.February, 15, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("periodStart(15, %v) = %v, want Feb 15", now, got)
+	}
+	if got := periodStart(5, now); !got.Equal(time.Date(2026, time.March, 5, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("periodStart(5, %v) = %v, want Mar 5", now, got)
+	}
+}
+
+func TestPeriodStartClampsToDaysInMonth(t *testing.T) {
+	// April has 30 days, so rolloverDay 31 should clamp to April 30, not
+	// overflow into May 1st.
+	now := time.Date(2026, time.May, 1, 0, 0, 0, 0, time.UTC)
+	got := periodStart(31, now)
+	want := time.Date(2026, time.April, 30, 0, 0, 0, 0, time.UTC)
+	if !got.Equal(want) {
+		t.Errorf("periodStart(31, %v) = %v, want %v", now, got, want)
+	}
+}
+
+func TestPeriodStartClampsFebruary(t *testing.T) {
+	// February never reaches day 30, so rolloverDay 30 clamps to February's
+	// last day: the period rolls over on February 28 instead of waiting for
+	// March 30.
+	now := time.Date(2026, time.February, 28, 0, 0, 0, 0, time.UTC) // 2026 is not a leap year
+	got := periodStart(30, now)
+	want := time.Date(2026, time.February, 28, 0, 0, 0, 0, time.UTC)
+	if !got.Equal(want) {
+		t.Errorf("periodStart(30, %v) = %v, want %v", now, got, want)
+	}
+}
+
+func TestMemStoreRollsOverUsage(t *testing.T) {
+	s := &MemStore{
+		rolloverDay: 1,
+		usage:       make(map[string]int64),
+		periodStart: time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC),
+	}
+	s.usage["key"] = 100
+
+	// rolloverIfNeeded uses time.Now(), so simulate being in a later period
+	// by backdating periodStart far enough that "now" has rolled past it.
+	s.periodStart = time.Now().AddDate(0, -2, 0)
+	if got := s.Usage("key"); got != 0 {
+		t.Errorf("Usage after rollover = %d, want 0", got)
+	}
+}
+
+func TestMemStoreAddUsageAccumulates(t *testing.T) {
+	s := NewMemStore(1)
+	s.AddUsage("key", 10)
+	if got := s.AddUsage("key", 5); got != 15 {
+		t.Errorf("AddUsage cumulative = %d, want 15", got)
+	}
+	if got := s.Usage("key"); got != 15 {
+		t.Errorf("Usage = %d, want 15", got)
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2018 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quota
+
+import (
+	"context"
+
+	onet "github.com/Jigsaw-Code/outline-ss-server/net"
+	"golang.org/x/time/rate"
+)
+
+// maxBurstBytes bounds the token bucket's burst size so that a single large
+// Read never exceeds it; the rate itself is what enforces the long-run cap.
+const maxBurstBytes = 64 * 1024
+
+// LimitedConn wraps a DuplexConn, throttling Read calls to bps bytes per
+// second. Relay pumps bytes read from one connection into writes on the
+// other, so throttling reads alone is enough to cap the whole proxied
+// direction.
+type LimitedConn struct {
+	onet.DuplexConn
+	limiter *rate.Limiter
+}
+
+// NewLimitedConn wraps conn with a token-bucket limiter sized at bps bytes
+// per second. A non-positive bps means unlimited, and conn is returned
+// unwrapped.
+func NewLimitedConn(conn onet.DuplexConn, bps int64) onet.DuplexConn {
+	if bps <= 0 {
+		return conn
+	}
+	return &LimitedConn{DuplexConn: conn, limiter: rate.NewLimiter(rate.Limit(bps), maxBurstBytes)}
+}
+
+// Read reads from the underlying connection and then blocks until the
+// bytes just read are accounted for by the limiter.
+func (c *LimitedConn) Read(p []byte) (int, error) {
+	if len(p) > maxBurstBytes {
+		p = p[:maxBurstBytes]
+	}
+	n, err := c.DuplexConn.Read(p)
+	if n > 0 {
+		if waitErr := c.limiter.WaitN(context.Background(), n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
@@ -26,11 +26,17 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/Jigsaw-Code/outline-ss-server/logging"
 	"github.com/Jigsaw-Code/outline-ss-server/metrics"
 	onet "github.com/Jigsaw-Code/outline-ss-server/net"
+	"github.com/Jigsaw-Code/outline-ss-server/quota"
+	"github.com/Jigsaw-Code/outline-ss-server/transport"
+	"github.com/Jigsaw-Code/outline-ss-server/trial"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/shadowsocks/go-shadowsocks2/core"
@@ -43,13 +49,106 @@ var config struct {
 	UDPTimeout time.Duration
 }
 
+// Authentication-trial tracking configuration, set from flags in main().
+var (
+	authTrackerMaxIPs    int
+	authTrackerWindow    time.Duration
+	authTrackerThreshold int
+)
+
+// quotaRolloverDay is the day of the month access key quotas reset, set
+// from a flag in main().
+var quotaRolloverDay int
+
+// logger is the structured logger used by the connection-handling hot
+// path; main() replaces it once -log-level has been parsed.
+var logger logging.Logger = logging.New(os.Stderr, logging.Info)
+
+// nextConnID assigns each TCP connection a unique, human-readable ID for
+// correlating its log records.
+var connIDCounter uint64
+
+func nextConnID() string {
+	return fmt.Sprintf("%x", atomic.AddUint64(&connIDCounter, 1))
+}
+
 type SSPort struct {
 	listener   *net.TCPListener
 	packetConn net.PacketConn
-	keys       map[string]shadowaead.Cipher
+	keys       map[string]*AccessKey
+	tracker    *trial.Tracker
+	transport  transport.Transport
+	// transportConfig is the PortConfig transport was built from, kept so
+	// loadConfig can tell an unchanged transport config from a changed one
+	// and reuse the existing instance rather than rebuilding it on every
+	// reload, discarding any state it holds (e.g. transport.TLSMimicry's
+	// replay-nonce cache) for no reason.
+	transportConfig PortConfig
+	quota           quota.Store
+}
+
+// AccessKey holds the cipher used to authenticate a client along with the
+// key's metadata. The SIP003/SIP008 fields among it (cipher name, secret,
+// label, plugin) are exposed on the provisioning endpoint in provisioning.go;
+// quota, expiry, networks and throughput limits are not.
+type AccessKey struct {
+	Cipher shadowaead.Cipher
+	// CipherName and Secret are kept alongside Cipher so the provisioning
+	// endpoint can hand them back to clients; the cipher itself only exposes
+	// the AEAD operations, not its configuration.
+	CipherName string
+	Secret     string
+	Label      string
+	// Plugin and PluginOpts identify a SIP003 plugin the client must run
+	// alongside Shadowsocks (e.g. v2ray-plugin); both are surfaced verbatim
+	// on the provisioning endpoint for SIP008 clients to pick up. Empty
+	// means no plugin.
+	Plugin     string
+	PluginOpts string
+	QuotaBytes int64
+	Expiry     time.Time
+	// Networks is the set of allowed network protocols ("tcp", "udp").
+	// A key with no entries is allowed on every network.
+	Networks map[string]bool
+	// BPSUp and BPSDown cap the key's upload and download throughput, in
+	// bytes per second. Zero means unlimited.
+	BPSUp   int64
+	BPSDown int64
+}
+
+// Expired reports whether the key's expiry date, if any, has passed.
+func (k *AccessKey) Expired() bool {
+	return !k.Expiry.IsZero() && time.Now().After(k.Expiry)
+}
+
+// AllowsNetwork reports whether the key may be used on the given network
+// ("tcp" or "udp"). Keys with no explicit restriction allow both.
+func (k *AccessKey) AllowsNetwork(network string) bool {
+	if len(k.Networks) == 0 {
+		return true
+	}
+	return k.Networks[network]
 }
 
-func findAccessKey(clientConn onet.DuplexConn, cipherList map[string]shadowaead.Cipher) (string, onet.DuplexConn, error) {
+// cipherListForNetwork returns the ciphers of keys that are current and
+// allowed on network ("tcp" or "udp"), so expired or network-restricted
+// keys are never offered as candidates on that network.
+func cipherListForNetwork(keys map[string]*AccessKey, network string) map[string]shadowaead.Cipher {
+	ciphers := make(map[string]shadowaead.Cipher, len(keys))
+	for id, key := range keys {
+		if key.Expired() || !key.AllowsNetwork(network) {
+			continue
+		}
+		ciphers[id] = key.Cipher
+	}
+	return ciphers
+}
+
+func findAccessKey(clientConn onet.DuplexConn, clientIP net.IP, keys map[string]*AccessKey, tracker *trial.Tracker) (string, onet.DuplexConn, error) {
+	if tracker != nil && tracker.Banned(clientIP) {
+		return "", nil, fmt.Errorf("client IP %v is banned for excessive authentication failures", clientIP)
+	}
+	cipherList := cipherListForNetwork(keys, "tcp")
 	if len(cipherList) == 0 {
 		return "", nil, errors.New("Empty cipher list")
 	} else if len(cipherList) == 1 {
@@ -59,14 +158,21 @@ func findAccessKey(clientConn onet.DuplexConn, cipherList map[string]shadowaead.
 			return id, onet.WrapConn(clientConn, reader, writer), nil
 		}
 	}
+	ids := make([]string, 0, len(cipherList))
+	for id := range cipherList {
+		ids = append(ids, id)
+	}
+	if tracker != nil {
+		// Try the cipher that last succeeded for this client IP first.
+		ids = tracker.OrderedKeyIDs(clientIP, ids)
+	}
 	// buffer saves the bytes read from shadowConn, in order to allow for replays.
 	var buffer bytes.Buffer
 	// Try each cipher until we find one that authenticates successfully.
 	// This assumes that all ciphers are AEAD.
-	// TODO: Reorder list to try previously successful ciphers first for the client IP.
-	// TODO: Ban and log client IPs with too many failures too quick to protect against DoS.
-	for id, cipher := range cipherList {
-		log.Printf("Trying key %v", id)
+	for _, id := range ids {
+		cipher := cipherList[id]
+		logger.Debug("Trying key", logging.Fields{"keyID": id, "clientIP": clientIP.String()})
 		// tmpReader reuses the bytes read so far, falling back to shadowConn if it needs more
 		// bytes. All bytes read from shadowConn are saved in buffer.
 		tmpReader := io.MultiReader(bytes.NewReader(buffer.Bytes()), io.TeeReader(clientConn, &buffer))
@@ -75,10 +181,16 @@ func findAccessKey(clientConn onet.DuplexConn, cipherList map[string]shadowaead.
 		// Read should read just enough data to authenticate the payload size.
 		_, err := cipherReader.Read(make([]byte, 0))
 		if err != nil {
-			log.Printf("Failed key %v: %v", id, err)
+			logger.Debug("Failed key", logging.Fields{"keyID": id, "clientIP": clientIP.String(), "error": err.Error()})
+			if tracker != nil {
+				tracker.RecordFailure(clientIP)
+			}
 			continue
 		}
-		log.Printf("Selected key %v", id)
+		logger.Info("Selected key", logging.Fields{"keyID": id, "clientIP": clientIP.String()})
+		if tracker != nil {
+			tracker.RecordSuccess(clientIP, id)
+		}
 		// We don't need to replay the bytes anymore, but we don't want to drop those
 		// read so far.
 		ssr := shadowaead.NewShadowsocksReader(io.MultiReader(&buffer, clientConn), cipher)
@@ -97,49 +209,87 @@ type connectionError struct {
 
 // Listen on addr for incoming connections.
 func (port *SSPort) run(m metrics.ShadowsocksMetrics) {
-	go udpRemote(port.packetConn, port.keys, m)
+	go udpRemote(port, m)
 	for {
 		var clientConn onet.DuplexConn
 		clientConn, err := port.listener.AcceptTCP()
 		if err != nil {
-			log.Printf("failed to accept: %v", err)
+			logger.Warn("Failed to accept", logging.Fields{"error": err.Error()})
 			continue
 		}
 		m.AddOpenTCPConnection()
 
+		connID := nextConnID()
+
 		go func() (connError *connectionError) {
 			defer func() {
 				if r := recover(); r != nil {
-					log.Printf("ERROR Panic in TCP handler: %v", r)
+					logger.Error("Panic in TCP handler", logging.Fields{"connID": connID, "panic": r})
 				}
 			}()
 			connStart := time.Now()
 			clientConn.(*net.TCPConn).SetKeepAlive(true)
 			keyID := ""
+			keyLabel := ""
+			var targetHost string
 			var proxyMetrics metrics.ProxyMetrics
 			clientConn = metrics.MeasureConn(clientConn, &proxyMetrics.ProxyClient, &proxyMetrics.ClientProxy)
 			defer func() {
-				connEnd := time.Now()
-				connDuration := connEnd.Sub(connStart)
+				connDuration := time.Since(connStart)
 				clientConn.Close()
 				status := "OK"
+				fields := logging.Fields{
+					"connID":     connID,
+					"keyID":      keyID,
+					"keyLabel":   keyLabel,
+					"targetHost": targetHost,
+					"bytesUp":    proxyMetrics.ClientProxy,
+					"bytesDown":  proxyMetrics.ProxyClient,
+					"durationMs": connDuration.Milliseconds(),
+					"status":     status,
+				}
 				if connError != nil {
-					log.Printf("ERROR [TCP] %v: %v", connError.message, connError.cause)
 					status = connError.status
+					fields["status"] = status
+					fields["error"] = connError.cause.Error()
+					logger.Warn(connError.message, fields)
 				}
-				log.Printf("Done with status %v, duration %v", status, connDuration)
+				logger.Info("Done", fields)
+				// TODO: surface keyLabel as a metrics label too, once the
+				// metrics package (outside this repo slice) grows a
+				// parameter for it; AddClosedTCPConnection only takes
+				// keyID today.
 				m.AddClosedTCPConnection(keyID, status, proxyMetrics, connDuration)
+				if keyID != "" && port.quota != nil {
+					port.quota.AddUsage(keyID, proxyMetrics.ClientProxy+proxyMetrics.ProxyClient)
+				}
 			}()
 
-			keyID, clientConn, err := findAccessKey(clientConn, port.keys)
+			clientIP := clientConn.RemoteAddr().(*net.TCPAddr).IP
+			preparedConn, err := port.transport.PrepareConnection(clientConn)
+			if err != nil {
+				return &connectionError{"ERR_TRANSPORT", "Failed to prepare connection transport", err}
+			}
+			clientConn = preparedConn.(onet.DuplexConn)
+
+			keyID, clientConn, err := findAccessKey(clientConn, clientIP, port.keys, port.tracker)
 			if err != nil {
 				return &connectionError{"ERR_CIPHER", "Failed to find a valid cipher", err}
 			}
 
+			accessKey := port.keys[keyID]
+			keyLabel = accessKey.Label
+			if port.quota != nil && accessKey.QuotaBytes > 0 && port.quota.Usage(keyID) >= accessKey.QuotaBytes {
+				quota.ExceededTotal.Inc()
+				return &connectionError{"ERR_QUOTA_EXCEEDED", "Access key has exceeded its quota", fmt.Errorf("usage has reached the %d byte quota", accessKey.QuotaBytes)}
+			}
+			clientConn = quota.NewLimitedConn(clientConn, accessKey.BPSUp)
+
 			tgt, err := socks.ReadAddr(clientConn)
 			if err != nil {
 				return &connectionError{"ERR_READ_ADDRESS", "Failed to get target address", err}
 			}
+			targetHost = tgt.String()
 
 			c, err := net.Dial("tcp", tgt.String())
 			if err != nil {
@@ -149,9 +299,11 @@ func (port *SSPort) run(m metrics.ShadowsocksMetrics) {
 			defer tgtConn.Close()
 			tgtConn.(*net.TCPConn).SetKeepAlive(true)
 			tgtConn = metrics.MeasureConn(tgtConn, &proxyMetrics.ProxyTarget, &proxyMetrics.TargetProxy)
+			tgtConn = quota.NewLimitedConn(tgtConn, accessKey.BPSDown)
 
-			// TODO: Disable logging in production. This is sensitive.
-			log.Printf("proxy %s <-> %s", clientConn.RemoteAddr(), tgt)
+			// This line is sensitive: it pairs a client IP with the site it's
+			// visiting. Only emitted at debug level.
+			logger.Debug("proxy", logging.Fields{"connID": connID, "clientIP": clientIP.String(), "targetHost": targetHost})
 			_, _, err = onet.Relay(clientConn, tgtConn)
 			if err != nil {
 				return &connectionError{"ERR_RELAY", "Failed to relay traffic", err}
@@ -162,10 +314,15 @@ func (port *SSPort) run(m metrics.ShadowsocksMetrics) {
 }
 
 type SSServer struct {
-	m     metrics.ShadowsocksMetrics
-	ports map[int]*SSPort
+	m              metrics.ShadowsocksMetrics
+	mu             sync.RWMutex // guards ports, which SIGHUP, the admin API, and the provisioning endpoint all touch
+	ports          map[int]*SSPort
+	tracker        *trial.Tracker
+	quota          quota.Store
+	configFilename string
 }
 
+// startPort must be called with s.mu held for writing.
 func (s *SSServer) startPort(portNum int) error {
 	listener, err := net.ListenTCP("tcp", &net.TCPAddr{Port: portNum})
 	if err != nil {
@@ -176,12 +333,20 @@ func (s *SSServer) startPort(portNum int) error {
 		return fmt.Errorf("ERROR Failed to start UDP on port %v: %v", portNum, err)
 	}
 	log.Printf("INFO Listening TCP and UDP on port %v", portNum)
-	port := &SSPort{listener: listener, packetConn: packetConn, keys: make(map[string]shadowaead.Cipher)}
+	port := &SSPort{
+		listener:   listener,
+		packetConn: packetConn,
+		keys:       make(map[string]*AccessKey),
+		tracker:    s.tracker,
+		transport:  transport.Direct{},
+		quota:      s.quota,
+	}
 	s.ports[portNum] = port
 	go port.run(s.m)
 	return nil
 }
 
+// removePort must be called with s.mu held for writing.
 func (s *SSServer) removePort(portNum int) error {
 	port, ok := s.ports[portNum]
 	if !ok {
@@ -200,33 +365,27 @@ func (s *SSServer) removePort(portNum int) error {
 	return nil
 }
 
+// loadConfig reads filename and applies it, starting and stopping ports as
+// needed. It serializes against concurrent reloads (SIGHUP, the admin
+// API's /reload, and key upserts/removals all call this) and against
+// readers of s.ports like the provisioning endpoint, since it rebuilds
+// SSPort.keys and starts/stops listeners in place.
 func (s *SSServer) loadConfig(filename string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	config, err := readConfig(filename)
 	if err != nil {
 		return fmt.Errorf("Failed to read config file %v: %v", filename, err)
 	}
 
+	portKeys, err := buildPortKeys(config)
+	if err != nil {
+		return err
+	}
 	portChanges := make(map[int]int)
-	portKeys := make(map[int]map[string]shadowaead.Cipher)
 	for _, keyConfig := range config.Keys {
 		portChanges[keyConfig.Port] = 1
-		keys, ok := portKeys[keyConfig.Port]
-		if !ok {
-			keys = make(map[string]shadowaead.Cipher)
-			portKeys[keyConfig.Port] = keys
-		}
-		cipher, err := core.PickCipher(keyConfig.Cipher, nil, keyConfig.Secret)
-		if err != nil {
-			if err == core.ErrCipherNotSupported {
-				return fmt.Errorf("Cipher %v for key %v is not supported", keyConfig.Cipher, keyConfig.ID)
-			}
-			return fmt.Errorf("Failed to create cipher for key %v: %v", keyConfig.ID, err)
-		}
-		aead, ok := cipher.(shadowaead.Cipher)
-		if !ok {
-			return fmt.Errorf("Only AEAD ciphers are supported. Found %v", keyConfig.Cipher)
-		}
-		keys[keyConfig.ID] = aead
 	}
 	for port := range s.ports {
 		portChanges[port] = portChanges[port] - 1
@@ -245,16 +404,52 @@ func (s *SSServer) loadConfig(filename string) error {
 	for portNum, keys := range portKeys {
 		s.ports[portNum].keys = keys
 	}
-	log.Printf("INFO Loaded %v access keys", len(config.Keys))
+	configured := make(map[int]bool, len(config.Ports))
+	for _, portConfig := range config.Ports {
+		configured[portConfig.Port] = true
+	}
+	for portNum, port := range s.ports {
+		if !configured[portNum] {
+			// No transport entry for this port (any more): back to vanilla Shadowsocks.
+			port.transport = transport.Direct{}
+			port.transportConfig = PortConfig{}
+		}
+	}
+	for _, portConfig := range config.Ports {
+		port, ok := s.ports[portConfig.Port]
+		if !ok {
+			return fmt.Errorf("Port %v has a transport but no access keys", portConfig.Port)
+		}
+		if port.transportConfig == portConfig {
+			// Transport config for this port hasn't changed since the last
+			// load: keep the existing instance instead of rebuilding it, so
+			// state like transport.TLSMimicry's replay-nonce cache survives
+			// routine reloads (SIGHUP, the admin API) that don't touch it.
+			continue
+		}
+		t, err := newTransport(portConfig)
+		if err != nil {
+			return fmt.Errorf("Failed to configure transport for port %v: %v", portConfig.Port, err)
+		}
+		port.transport = t
+		port.transportConfig = portConfig
+	}
+	logger.Info("Loaded access keys", logging.Fields{"numKeys": len(config.Keys)})
 	s.m.SetNumAccessKeys(len(config.Keys), len(portKeys))
 	return nil
 }
 
-func runSSServer(filename string) error {
-	server := &SSServer{m: metrics.NewShadowsocksMetrics(), ports: make(map[int]*SSPort)}
+func runSSServer(filename string) (*SSServer, error) {
+	server := &SSServer{
+		m:              metrics.NewShadowsocksMetrics(),
+		ports:          make(map[int]*SSPort),
+		tracker:        trial.NewTracker(authTrackerMaxIPs, authTrackerWindow, authTrackerThreshold),
+		quota:          quota.NewMemStore(quotaRolloverDay),
+		configFilename: filename,
+	}
 	err := server.loadConfig(filename)
 	if err != nil {
-		return fmt.Errorf("Failed to load config file %v: %v", filename, err)
+		return nil, fmt.Errorf("Failed to load config file %v: %v", filename, err)
 	}
 	sigHup := make(chan os.Signal, 1)
 	signal.Notify(sigHup, syscall.SIGHUP)
@@ -266,18 +461,123 @@ func runSSServer(filename string) error {
 			}
 		}
 	}()
-	return nil
+	return server, nil
 }
 
 type Config struct {
-	Keys []struct {
-		ID     string
-		Port   int
-		Cipher string
-		Secret string
+	Keys  []KeyConfig
+	Ports []PortConfig `yaml:"ports,omitempty"`
+}
+
+// PortConfig configures the transport used by a single port. Ports with no
+// entry here default to vanilla Shadowsocks (transport.Direct).
+type PortConfig struct {
+	Port int
+	// Transport selects the wire-format disguise for this port: "direct"
+	// (the default) or "tls-mimicry".
+	Transport string `yaml:"transport"`
+	// Secret authenticates clients of a tls-mimicry port; required when
+	// Transport is "tls-mimicry".
+	Secret string `yaml:"secret,omitempty"`
+}
+
+// KeyConfig is the YAML representation of a single access key, including its
+// metadata (label, plugin, quota, expiry, allowed networks, throughput
+// limits). Of that metadata, the provisioning endpoint serves only the label
+// and plugin settings back to clients.
+type KeyConfig struct {
+	ID     string
+	Port   int
+	Cipher string
+	Secret string
+	// Label is a human-readable name for the key (SIP008 "email" / "label").
+	Label string `yaml:"label,omitempty"`
+	// Plugin and PluginOpts configure a SIP003 plugin clients of this key
+	// must launch alongside Shadowsocks (e.g. v2ray-plugin). Empty means
+	// no plugin.
+	Plugin     string `yaml:"plugin,omitempty"`
+	PluginOpts string `yaml:"plugin_opts,omitempty"`
+	// QuotaBytes is the monthly data cap for the key, in bytes. Zero means unlimited.
+	QuotaBytes int64 `yaml:"quota_bytes,omitempty"`
+	// Expiry is the date (YYYY-MM-DD) after which the key stops working.
+	Expiry string `yaml:"expiry,omitempty"`
+	// Networks restricts the key to a subset of {"tcp", "udp"}. Empty means both.
+	Networks []string `yaml:"networks,omitempty"`
+	// BPSUp and BPSDown cap the key's upload and download throughput, in
+	// bytes per second. Zero means unlimited.
+	BPSUp   int64 `yaml:"bps_up,omitempty"`
+	BPSDown int64 `yaml:"bps_down,omitempty"`
+}
+
+// newTransport builds the transport.Transport described by portConfig.
+func newTransport(portConfig PortConfig) (transport.Transport, error) {
+	switch portConfig.Transport {
+	case "", "direct":
+		return transport.Direct{}, nil
+	case "tls-mimicry":
+		if portConfig.Secret == "" {
+			return nil, fmt.Errorf("tls-mimicry requires a secret")
+		}
+		return &transport.TLSMimicry{Secret: []byte(portConfig.Secret)}, nil
+	default:
+		return nil, fmt.Errorf("unknown transport %q", portConfig.Transport)
 	}
 }
 
+// buildPortKeys validates config and builds the per-port access key maps
+// loadConfig installs. It performs no side effects, so callers that only
+// need to know whether config is valid (the admin API, before persisting a
+// candidate change) can call it without touching server or listener state.
+func buildPortKeys(config *Config) (map[int]map[string]*AccessKey, error) {
+	portKeys := make(map[int]map[string]*AccessKey)
+	for _, keyConfig := range config.Keys {
+		keys, ok := portKeys[keyConfig.Port]
+		if !ok {
+			keys = make(map[string]*AccessKey)
+			portKeys[keyConfig.Port] = keys
+		}
+		cipher, err := core.PickCipher(keyConfig.Cipher, nil, keyConfig.Secret)
+		if err != nil {
+			if err == core.ErrCipherNotSupported {
+				return nil, fmt.Errorf("Cipher %v for key %v is not supported", keyConfig.Cipher, keyConfig.ID)
+			}
+			return nil, fmt.Errorf("Failed to create cipher for key %v: %v", keyConfig.ID, err)
+		}
+		aead, ok := cipher.(shadowaead.Cipher)
+		if !ok {
+			return nil, fmt.Errorf("Only AEAD ciphers are supported. Found %v", keyConfig.Cipher)
+		}
+		var expiry time.Time
+		if keyConfig.Expiry != "" {
+			expiry, err = time.Parse("2006-01-02", keyConfig.Expiry)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to parse expiry date for key %v: %v", keyConfig.ID, err)
+			}
+		}
+		var networks map[string]bool
+		if len(keyConfig.Networks) > 0 {
+			networks = make(map[string]bool, len(keyConfig.Networks))
+			for _, network := range keyConfig.Networks {
+				networks[network] = true
+			}
+		}
+		keys[keyConfig.ID] = &AccessKey{
+			Cipher:     aead,
+			CipherName: keyConfig.Cipher,
+			Secret:     keyConfig.Secret,
+			Label:      keyConfig.Label,
+			Plugin:     keyConfig.Plugin,
+			PluginOpts: keyConfig.PluginOpts,
+			QuotaBytes: keyConfig.QuotaBytes,
+			Expiry:     expiry,
+			Networks:   networks,
+			BPSUp:      keyConfig.BPSUp,
+			BPSDown:    keyConfig.BPSDown,
+		}
+	}
+	return portKeys, nil
+}
+
 func readConfig(filename string) (*Config, error) {
 	config := Config{}
 	configData, err := ioutil.ReadFile(filename)
@@ -288,14 +588,37 @@ func readConfig(filename string) (*Config, error) {
 	return &config, err
 }
 
+// writeConfig serializes config back to filename, for admin API changes
+// that need to survive a restart and be visible in the YAML source of
+// truth.
+func writeConfig(filename string, config *Config) error {
+	configData, err := yaml.Marshal(config)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, configData, 0o644)
+}
+
 func main() {
 	var flags struct {
-		ConfigFile  string
-		MetricsAddr string
+		ConfigFile       string
+		MetricsAddr      string
+		ProvisioningAddr string
+		ProvisioningHost string
+		AdminAddr        string
+		LogLevel         string
 	}
 	flag.StringVar(&flags.ConfigFile, "config", "", "config filename")
 	flag.StringVar(&flags.MetricsAddr, "metrics", "", "address for the Prometheus metrics")
+	flag.StringVar(&flags.ProvisioningAddr, "provisioning-addr", "", "address for the SIP008 provisioning endpoint")
+	flag.StringVar(&flags.ProvisioningHost, "provisioning-host", "", "hostname reported to clients in SIP008 responses")
+	flag.StringVar(&flags.AdminAddr, "admin-addr", "", "address for the key-management admin API")
+	flag.StringVar(&flags.LogLevel, "log-level", "info", "minimum level to log: debug, info, warn, or error")
 	flag.DurationVar(&config.UDPTimeout, "udptimeout", 5*time.Minute, "UDP tunnel timeout")
+	flag.IntVar(&authTrackerMaxIPs, "auth-trial-lru-size", 10000, "number of client IPs to remember for cipher reordering and ban tracking")
+	flag.DurationVar(&authTrackerWindow, "auth-trial-window", 30*time.Second, "window over which authentication failures are counted for banning")
+	flag.IntVar(&authTrackerThreshold, "auth-trial-threshold", 10, "number of authentication failures within the window above which a client IP is banned")
+	flag.IntVar(&quotaRolloverDay, "quota-rollover-day", 1, "day of the month access key quotas reset")
 
 	flag.Parse()
 
@@ -304,6 +627,12 @@ func main() {
 		return
 	}
 
+	logLevel, err := logging.ParseLevel(flags.LogLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	logger = logging.New(os.Stderr, logLevel)
+
 	if flags.MetricsAddr != "" {
 		http.Handle("/metrics", promhttp.Handler())
 		go func() {
@@ -312,11 +641,23 @@ func main() {
 		log.Printf("Metrics on http://%v/metrics", flags.MetricsAddr)
 	}
 
-	err := runSSServer(flags.ConfigFile)
+	server, err := runSSServer(flags.ConfigFile)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if flags.ProvisioningAddr != "" {
+		if err := startProvisioningServer(flags.ProvisioningAddr, flags.ProvisioningHost, server); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if flags.AdminAddr != "" {
+		if err := startAdminServer(flags.AdminAddr, server); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 	<-sigCh
@@ -0,0 +1,148 @@
+// Copyright 2018 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// validClientRandom builds a 32-byte ClientHello random that authenticate
+// accepts: an 8-byte timestamp, an 8-byte nonce, and the 16-byte HMAC of
+// both over secret.
+func validClientRandom(secret []byte, ts time.Time, nonce uint64) []byte {
+	r := make([]byte, 32)
+	binary.BigEndian.PutUint64(r[:8], uint64(ts.Unix()))
+	binary.BigEndian.PutUint64(r[8:16], nonce)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(r[:16])
+	copy(r[16:], mac.Sum(nil)[:16])
+	return r
+}
+
+func TestAuthenticateAcceptsFreshClientRandom(t *testing.T) {
+	secret := []byte("shared-secret")
+	mimicry := &TLSMimicry{Secret: secret}
+	random := validClientRandom(secret, time.Now(), 1)
+	if err := mimicry.authenticate(random); err != nil {
+		t.Fatalf("authenticate() = %v, want nil", err)
+	}
+}
+
+func TestAuthenticateRejectsWrongSecret(t *testing.T) {
+	mimicry := &TLSMimicry{Secret: []byte("shared-secret")}
+	random := validClientRandom([]byte("wrong-secret"), time.Now(), 2)
+	if err := mimicry.authenticate(random); err == nil {
+		t.Fatal("authenticate() = nil, want error for a mismatched secret")
+	}
+}
+
+func TestAuthenticateRejectsStaleTimestamp(t *testing.T) {
+	secret := []byte("shared-secret")
+	mimicry := &TLSMimicry{Secret: secret}
+	random := validClientRandom(secret, time.Now().Add(-time.Hour), 3)
+	if err := mimicry.authenticate(random); err == nil {
+		t.Fatal("authenticate() = nil, want error for a stale timestamp")
+	}
+}
+
+func TestAuthenticateRejectsReplayedClientRandom(t *testing.T) {
+	secret := []byte("shared-secret")
+	mimicry := &TLSMimicry{Secret: secret}
+	random := validClientRandom(secret, time.Now(), 4)
+	if err := mimicry.authenticate(random); err != nil {
+		t.Fatalf("first authenticate() = %v, want nil", err)
+	}
+	if err := mimicry.authenticate(random); err == nil {
+		t.Fatal("second authenticate() with the same client random = nil, want error")
+	}
+}
+
+func TestReadClientHelloExtractsRandom(t *testing.T) {
+	secret := []byte("shared-secret")
+	random := validClientRandom(secret, time.Now(), 5)
+
+	serverSide, clientSide := net.Pipe()
+	defer serverSide.Close()
+	defer clientSide.Close()
+
+	go func() {
+		var body []byte
+		body = append(body, handshakeTypeClientHello, 0, 0, 0) // handshake type + 24-bit length, filled below
+		body = append(body, tlsLegacyVersion[:]...)
+		body = append(body, random...)
+		payloadLen := len(body) - 4
+		body[1] = byte(payloadLen >> 16)
+		body[2] = byte(payloadLen >> 8)
+		body[3] = byte(payloadLen)
+		header := []byte{recordTypeHandshake, tlsLegacyVersion[0], tlsLegacyVersion[1], byte(len(body) >> 8), byte(len(body))}
+		clientSide.Write(header)
+		clientSide.Write(body)
+	}()
+
+	mimicry := &TLSMimicry{Secret: secret}
+	got, err := mimicry.readClientHello(serverSide)
+	if err != nil {
+		t.Fatalf("readClientHello() error = %v", err)
+	}
+	if !hmac.Equal(got, random) {
+		t.Fatalf("readClientHello() = %x, want %x", got, random)
+	}
+}
+
+func TestWriteServerHandshakeProducesHandshakeRecord(t *testing.T) {
+	serverSide, clientSide := net.Pipe()
+	defer serverSide.Close()
+	defer clientSide.Close()
+
+	mimicry := &TLSMimicry{Secret: []byte("shared-secret")}
+	errCh := make(chan error, 1)
+	go func() { errCh <- mimicry.writeServerHandshake(serverSide) }()
+
+	header := make([]byte, 5)
+	if _, err := readFull(clientSide, header); err != nil {
+		t.Fatalf("failed to read record header: %v", err)
+	}
+	if header[0] != recordTypeHandshake {
+		t.Fatalf("record type = %v, want handshake", header[0])
+	}
+	length := int(binary.BigEndian.Uint16(header[3:5]))
+	body := make([]byte, length)
+	if _, err := readFull(clientSide, body); err != nil {
+		t.Fatalf("failed to read record body: %v", err)
+	}
+	if body[0] != handshakeTypeServerHello {
+		t.Fatalf("first handshake message type = %v, want ServerHello", body[0])
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("writeServerHandshake() error = %v", err)
+	}
+}
+
+func readFull(conn net.Conn, buf []byte) (int, error) {
+	total := 0
+	for total < len(buf) {
+		n, err := conn.Read(buf[total:])
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
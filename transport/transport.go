@@ -0,0 +1,38 @@
+// Copyright 2018 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package transport provides pluggable wire-format layers that sit between
+// the raw TCP connection and the Shadowsocks AEAD stream, so that a port
+// can disguise its traffic (e.g. as TLS) for networks that block plain
+// Shadowsocks.
+package transport
+
+import "net"
+
+// Transport prepares a freshly-accepted client connection for the
+// Shadowsocks AEAD layer. Implementations perform whatever handshake their
+// disguise requires and return a net.Conn whose Read and Write operate on
+// the underlying Shadowsocks byte stream.
+type Transport interface {
+	PrepareConnection(conn net.Conn) (net.Conn, error)
+}
+
+// Direct is the identity Transport used by ports that carry vanilla
+// Shadowsocks with no additional disguise.
+type Direct struct{}
+
+// PrepareConnection returns conn unchanged.
+func (Direct) PrepareConnection(conn net.Conn) (net.Conn, error) {
+	return conn, nil
+}
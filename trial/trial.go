@@ -0,0 +1,179 @@
+// Copyright 2018 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package trial tracks per-client-IP authentication history so that
+// SSPort.run can reorder its cipher trials towards the key that last
+// succeeded for a given IP, and can ban IPs that fail authentication too
+// often in too short a window (a cheap defense against cipher-guessing
+// and port-scanning).
+package trial
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var bansTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "shadowsocks",
+	Subsystem: "auth",
+	Name:      "bans_total",
+	Help:      "Total number of client IPs banned for excessive authentication failures",
+}, []string{"reason"})
+
+func init() {
+	prometheus.MustRegister(bansTotal)
+}
+
+// history is the authentication history kept for a single client IP.
+type history struct {
+	lastSuccessKeyID string
+	failures         []time.Time
+}
+
+// Tracker remembers, per client IP, the access key that last authenticated
+// successfully and the timestamps of recent authentication failures. It is
+// safe for concurrent use.
+type Tracker struct {
+	mu        sync.Mutex
+	maxIPs    int
+	window    time.Duration
+	threshold int
+	order     *list.List               // front = most recently used IP
+	entries   map[string]*list.Element // ip.String() -> element holding *ipEntry
+}
+
+type ipEntry struct {
+	ip      string
+	history history
+}
+
+// NewTracker creates a Tracker that bans an IP once it has produced more
+// than threshold authentication failures within window, keeping history for at
+// most maxIPs distinct client IPs (evicting the least recently used).
+func NewTracker(maxIPs int, window time.Duration, threshold int) *Tracker {
+	return &Tracker{
+		maxIPs:    maxIPs,
+		window:    window,
+		threshold: threshold,
+		order:     list.New(),
+		entries:   make(map[string]*list.Element),
+	}
+}
+
+// Banned reports whether ip has exceeded the failure threshold within the
+// configured window. It also prunes failure timestamps that have fallen
+// outside the window.
+func (t *Tracker) Banned(ip net.IP) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	elem, ok := t.entries[ip.String()]
+	if !ok {
+		return false
+	}
+	entry := elem.Value.(*ipEntry)
+	entry.history.failures = recentFailures(entry.history.failures, t.window)
+	banned := len(entry.history.failures) > t.threshold
+	if banned {
+		bansTotal.WithLabelValues("too_many_failures").Inc()
+	}
+	return banned
+}
+
+// OrderedKeyIDs returns the key IDs of keys, with the ID that last
+// authenticated successfully for ip (if any, and if still present among
+// keyIDs) moved to the front.
+func (t *Tracker) OrderedKeyIDs(ip net.IP, keyIDs []string) []string {
+	t.mu.Lock()
+	last := ""
+	if elem, ok := t.entries[ip.String()]; ok {
+		last = elem.Value.(*ipEntry).history.lastSuccessKeyID
+	}
+	t.mu.Unlock()
+	found := false
+	for _, id := range keyIDs {
+		if id == last {
+			found = true
+			break
+		}
+	}
+	if last == "" || !found {
+		return keyIDs
+	}
+	ordered := make([]string, 0, len(keyIDs))
+	ordered = append(ordered, last)
+	for _, id := range keyIDs {
+		if id != last {
+			ordered = append(ordered, id)
+		}
+	}
+	return ordered
+}
+
+// RecordSuccess remembers keyID as the key that last authenticated
+// successfully for ip.
+func (t *Tracker) RecordSuccess(ip net.IP, keyID string) {
+	t.touch(ip, func(entry *ipEntry) {
+		entry.history.lastSuccessKeyID = keyID
+	})
+}
+
+// RecordFailure appends a failure timestamp for ip, to be consulted by
+// Banned.
+func (t *Tracker) RecordFailure(ip net.IP) {
+	t.touch(ip, func(entry *ipEntry) {
+		entry.history.failures = append(recentFailures(entry.history.failures, t.window), time.Now())
+	})
+}
+
+// touch finds or creates the entry for ip, marks it most recently used
+// (evicting the least recently used entry if the tracker is over
+// capacity), and applies mutate to it while still holding t.mu, so callers
+// never see or modify an entry's history outside the lock.
+func (t *Tracker) touch(ip net.IP, mutate func(*ipEntry)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := ip.String()
+	var entry *ipEntry
+	if elem, ok := t.entries[key]; ok {
+		t.order.MoveToFront(elem)
+		entry = elem.Value.(*ipEntry)
+	} else {
+		entry = &ipEntry{ip: key}
+		elem := t.order.PushFront(entry)
+		t.entries[key] = elem
+		if t.maxIPs > 0 && t.order.Len() > t.maxIPs {
+			oldest := t.order.Back()
+			if oldest != nil {
+				t.order.Remove(oldest)
+				delete(t.entries, oldest.Value.(*ipEntry).ip)
+			}
+		}
+	}
+	mutate(entry)
+}
+
+func recentFailures(failures []time.Time, window time.Duration) []time.Time {
+	cutoff := time.Now().Add(-window)
+	i := 0
+	for ; i < len(failures); i++ {
+		if failures[i].After(cutoff) {
+			break
+		}
+	}
+	return failures[i:]
+}
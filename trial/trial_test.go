@@ -0,0 +1,95 @@
+// Copyright 2018 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trial
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func mustIP(t *testing.T, s string) net.IP {
+	t.Helper()
+	ip := net.ParseIP(s)
+	if ip == nil {
+		t.Fatalf("invalid test IP %q", s)
+	}
+	return ip
+}
+
+func TestBannedAfterThreshold(t *testing.T) {
+	tracker := NewTracker(10, time.Minute, 2)
+	ip := mustIP(t, "10.0.0.1")
+	for i := 0; i <= 2; i++ {
+		if tracker.Banned(ip) {
+			t.Fatalf("banned after %d failures, want not banned until over threshold", i)
+		}
+		tracker.RecordFailure(ip)
+	}
+	if !tracker.Banned(ip) {
+		t.Fatal("not banned after exceeding the failure threshold")
+	}
+}
+
+func TestBannedPrunesOldFailures(t *testing.T) {
+	tracker := NewTracker(10, 10*time.Millisecond, 1)
+	ip := mustIP(t, "10.0.0.2")
+	tracker.RecordFailure(ip)
+	tracker.RecordFailure(ip)
+	if !tracker.Banned(ip) {
+		t.Fatal("expected ban with failures inside the window")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if tracker.Banned(ip) {
+		t.Fatal("expected failures outside the window to be pruned")
+	}
+}
+
+func TestOrderedKeyIDsMovesLastSuccessToFront(t *testing.T) {
+	tracker := NewTracker(10, time.Minute, 10)
+	ip := mustIP(t, "10.0.0.3")
+	tracker.RecordSuccess(ip, "b")
+	ordered := tracker.OrderedKeyIDs(ip, []string{"a", "b", "c"})
+	if len(ordered) != 3 || ordered[0] != "b" {
+		t.Fatalf("OrderedKeyIDs = %v, want b first", ordered)
+	}
+}
+
+func TestOrderedKeyIDsIgnoresStaleKeyID(t *testing.T) {
+	tracker := NewTracker(10, time.Minute, 10)
+	ip := mustIP(t, "10.0.0.4")
+	tracker.RecordSuccess(ip, "removed")
+	ordered := tracker.OrderedKeyIDs(ip, []string{"a", "b"})
+	if len(ordered) != 2 || ordered[0] == "removed" {
+		t.Fatalf("OrderedKeyIDs = %v, want the stale key ID dropped", ordered)
+	}
+}
+
+func TestTrackerEvictsLeastRecentlyUsed(t *testing.T) {
+	tracker := NewTracker(2, time.Minute, 10)
+	ipA := mustIP(t, "10.0.0.5")
+	ipB := mustIP(t, "10.0.0.6")
+	ipC := mustIP(t, "10.0.0.7")
+	tracker.RecordSuccess(ipA, "a")
+	tracker.RecordSuccess(ipB, "b")
+	tracker.RecordSuccess(ipC, "c") // evicts ipA, the least recently used
+
+	if ordered := tracker.OrderedKeyIDs(ipA, []string{"x", "a"}); ordered[0] == "a" {
+		t.Fatal("expected ipA's history to have been evicted")
+	}
+	if ordered := tracker.OrderedKeyIDs(ipC, []string{"x", "c"}); ordered[0] != "c" {
+		t.Fatalf("expected ipC's history to survive eviction, got %v", ordered)
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright 2018 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-ss-server/logging"
+	"github.com/Jigsaw-Code/outline-ss-server/metrics"
+	"github.com/Jigsaw-Code/outline-ss-server/quota"
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+	"golang.org/x/time/rate"
+)
+
+// udpBufSize is sized for the largest UDP datagram a Shadowsocks client can
+// send; the AEAD framing caps the plaintext well under this.
+const udpBufSize = 64 * 1024
+
+// udpMaxBurstBytes mirrors quota.maxBurstBytes: it bounds a rate limiter's
+// burst size so a single large packet never exceeds it.
+const udpMaxBurstBytes = 64 * 1024
+
+// newByteLimiter returns a token-bucket limiter sized at bps bytes per
+// second, or nil for a non-positive bps (unlimited).
+func newByteLimiter(bps int64) *rate.Limiter {
+	if bps <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(bps), udpMaxBurstBytes)
+}
+
+// natEntry is a single client<->target UDP association: the key that
+// authenticated it, the socket dialed to the target, and the per-key
+// throughput limits that apply to it, the UDP equivalent of the
+// quota.LimitedConn wrapping done for TCP in SSPort.run. It's torn down
+// after config.UDPTimeout with no packet in either direction.
+type natEntry struct {
+	targetConn  *net.UDPConn
+	keyID       string
+	upLimiter   *rate.Limiter // client -> target, from the key's BPSUp
+	downLimiter *rate.Limiter // target -> client, from the key's BPSDown
+}
+
+// natMap tracks the client-address -> natEntry association for UDP, so a
+// reply from a target can find its way back to the client that opened the
+// association without re-running key lookup.
+type natMap struct {
+	mu      sync.Mutex
+	entries map[string]*natEntry
+}
+
+func newNATMap() *natMap {
+	return &natMap{entries: make(map[string]*natEntry)}
+}
+
+func (n *natMap) get(clientAddr string) *natEntry {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.entries[clientAddr]
+}
+
+func (n *natMap) set(clientAddr string, entry *natEntry) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.entries[clientAddr] = entry
+}
+
+func (n *natMap) del(clientAddr string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.entries, clientAddr)
+}
+
+// udpRemote relays UDP datagrams received on port's packetConn to the
+// target address they carry, and relays target responses back to the
+// client. Like findAccessKey for TCP, it selects the access key by
+// trial-decrypting each candidate cipher, since UDP Shadowsocks has no
+// handshake to authenticate against up front; keys that are expired, don't
+// allow "udp", or have exceeded their quota are never offered as
+// candidates or are rejected once found, and data is metered against
+// port.quota and throttled by the key's BPSUp/BPSDown, as SSPort.run does
+// for TCP. Unlike TCP, which adds the client-side byte counts to the quota
+// when a connection closes, UDP adds each packet's plaintext payload size
+// as it is relayed.
+//
+// udpRemote takes port rather than a snapshot of its keys, so that a
+// config reload that replaces port.keys (SIGHUP, the admin API) is picked
+// up on the next packet, the same way findAccessKey reads port.keys live
+// on every TCP connection.
+func udpRemote(port *SSPort, m metrics.ShadowsocksMetrics) {
+	clientConn := port.packetConn
+	defer clientConn.Close()
+	nm := newNATMap()
+	cipherBuf := make([]byte, udpBufSize)
+	for {
+		n, clientAddr, err := clientConn.ReadFrom(cipherBuf)
+		if err != nil {
+			logger.Warn("Failed to read from UDP client", logging.Fields{"error": err.Error()})
+			return
+		}
+		clientIP := udpClientIP(clientAddr)
+		keys := port.keys
+		keyID, payload, err := findAccessKeyUDP(keys, cipherBuf[:n])
+		if err != nil {
+			logger.Debug("Failed to find a valid UDP cipher", logging.Fields{"clientIP": clientIP.String(), "error": err.Error()})
+			continue
+		}
+		accessKey := keys[keyID]
+		quotaStore := port.quota
+		if quotaStore != nil && accessKey.QuotaBytes > 0 && quotaStore.Usage(keyID) >= accessKey.QuotaBytes {
+			quota.ExceededTotal.Inc()
+			continue
+		}
+
+		tgtAddr, tgtPayload := socks.SplitAddr(payload)
+		if tgtAddr == nil {
+			logger.Debug("Failed to parse target address in UDP packet", logging.Fields{"keyID": keyID})
+			continue
+		}
+		tgtUDPAddr, err := net.ResolveUDPAddr("udp", tgtAddr.String())
+		if err != nil {
+			logger.Debug("Failed to resolve UDP target", logging.Fields{"keyID": keyID, "error": err.Error()})
+			continue
+		}
+
+		entry := nm.get(clientAddr.String())
+		if entry == nil {
+			targetConn, err := net.ListenUDP("udp", nil)
+			if err != nil {
+				logger.Warn("Failed to open UDP target socket", logging.Fields{"error": err.Error()})
+				continue
+			}
+			entry = &natEntry{
+				targetConn:  targetConn,
+				keyID:       keyID,
+				upLimiter:   newByteLimiter(accessKey.BPSUp),
+				downLimiter: newByteLimiter(accessKey.BPSDown),
+			}
+			nm.set(clientAddr.String(), entry)
+			go relayUDPTargetToClient(clientConn, clientAddr, entry, port, nm)
+		}
+		entry.targetConn.SetReadDeadline(time.Now().Add(config.UDPTimeout))
+
+		if entry.upLimiter != nil {
+			if err := entry.upLimiter.WaitN(context.Background(), len(tgtPayload)); err != nil {
+				continue
+			}
+		}
+		sent, err := entry.targetConn.WriteToUDP(tgtPayload, tgtUDPAddr)
+		if err != nil {
+			logger.Debug("Failed to relay UDP packet to target", logging.Fields{"keyID": keyID, "error": err.Error()})
+			continue
+		}
+		if quotaStore != nil {
+			quotaStore.AddUsage(keyID, int64(sent))
+		}
+	}
+}
+
+// relayUDPTargetToClient reads responses from entry's target socket,
+// re-encrypts them under the access key that opened the association, and
+// writes them back to clientAddr via clientConn, until the target socket
+// times out, errors, or the key is no longer valid for UDP. It reads
+// port.keys/port.quota live on every packet, for the same reload-visibility
+// reason udpRemote does.
+func relayUDPTargetToClient(clientConn net.PacketConn, clientAddr net.Addr, entry *natEntry, port *SSPort, nm *natMap) {
+	defer func() {
+		entry.targetConn.Close()
+		nm.del(clientAddr.String())
+	}()
+	buf := make([]byte, udpBufSize)
+	packBuf := make([]byte, udpBufSize)
+	for {
+		n, _, err := entry.targetConn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		accessKey, ok := port.keys[entry.keyID]
+		if !ok || accessKey.Expired() || !accessKey.AllowsNetwork("udp") {
+			return
+		}
+		if entry.downLimiter != nil {
+			if err := entry.downLimiter.WaitN(context.Background(), n); err != nil {
+				return
+			}
+		}
+		packet, err := shadowaead.Pack(packBuf, buf[:n], accessKey.Cipher)
+		if err != nil {
+			logger.Debug("Failed to pack UDP response", logging.Fields{"keyID": entry.keyID, "error": err.Error()})
+			continue
+		}
+		if _, err := clientConn.WriteTo(packet, clientAddr); err != nil {
+			return
+		}
+		if quotaStore := port.quota; quotaStore != nil {
+			quotaStore.AddUsage(entry.keyID, int64(n))
+		}
+		entry.targetConn.SetReadDeadline(time.Now().Add(config.UDPTimeout))
+	}
+}
+
+// findAccessKeyUDP tries to decrypt packet with each key allowed on "udp",
+// the same trial-decryption approach findAccessKey uses for TCP.
+func findAccessKeyUDP(keys map[string]*AccessKey, packet []byte) (string, []byte, error) {
+	ciphers := cipherListForNetwork(keys, "udp")
+	plainBuf := make([]byte, len(packet))
+	for id, cipher := range ciphers {
+		buf, err := shadowaead.Unpack(plainBuf, packet, cipher)
+		if err != nil {
+			continue
+		}
+		return id, buf, nil
+	}
+	return "", nil, fmt.Errorf("could not find valid UDP key")
+}
+
+func udpClientIP(addr net.Addr) net.IP {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		return udpAddr.IP
+	}
+	return nil
+}